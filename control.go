@@ -0,0 +1,263 @@
+package tablecloth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+)
+
+// Optional: the path of a unix socket that the manager will listen on for
+// control commands.
+//
+// This is used by a newly started process with Takeover set to take over the
+// listening sockets from the process that's currently running.
+var ControlSocket string
+
+// Optional: when set, and ControlSocket is specified, the process will take over
+// the listening sockets from the process serving on ControlSocket instead of
+// listening afresh.  Once this process is ready (see ExplicitReady), the
+// previous process will gracefully stop its servers, and all its
+// ListenAndServe calls will return.
+//
+// This allows handing over to a process that isn't a descendant of the running
+// one (eg a new container, or a binary at a different path).  If there's no
+// process serving on ControlSocket, this will start listening as normal.
+var Takeover bool
+
+// The maximum number of file descriptors that can be received in a takeover.
+const maxTakeoverFds = 256
+
+type controlRequest struct {
+	Command string `json:"command"`
+}
+
+type controlResponse struct {
+	OK      bool     `json:"ok"`
+	Error   string   `json:"error,omitempty"`
+	Handoff *handoff `json:"handoff,omitempty"`
+}
+
+func (m *manager) serveControl() {
+	if ControlSocket == "" {
+		return
+	}
+
+	// Check that there isn't another process still serving on the socket
+	// before removing it.
+	conn, err := net.Dial("unix", ControlSocket)
+	if err == nil {
+		conn.Close()
+		log.Println("[tablecloth] control socket", ControlSocket, "is in use by another process, not listening")
+		return
+	}
+	os.Remove(ControlSocket)
+
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: ControlSocket, Net: "unix"})
+	if err != nil {
+		log.Println("[tablecloth] error listening on control socket:", err)
+		return
+	}
+	m.controlLock.Lock()
+	m.control = l
+	m.controlLock.Unlock()
+
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			// The listener has been closed
+			return
+		}
+		go m.handleControlConn(conn)
+	}
+}
+
+func (m *manager) closeControl() {
+	m.controlLock.Lock()
+	defer m.controlLock.Unlock()
+	if m.control != nil {
+		m.control.Close()
+		m.control = nil
+	}
+}
+
+func (m *manager) handleControlConn(conn *net.UnixConn) {
+	defer conn.Close()
+
+	dec := json.NewDecoder(conn)
+	var req controlRequest
+	err := dec.Decode(&req)
+	if err != nil {
+		return
+	}
+
+	switch req.Command {
+	case "takeover":
+		m.handleTakeover(conn, dec)
+	default:
+		writeControlResponse(conn, &controlResponse{Error: "unknown command: " + req.Command}, nil)
+	}
+}
+
+// handleTakeover passes all the listening sockets to the process on the other
+// end of conn, and then stops the servers once it reports that it's ready.
+func (m *manager) handleTakeover(conn *net.UnixConn, dec *json.Decoder) {
+	m.serversLock.Lock()
+	defer m.serversLock.Unlock()
+
+	h, err := m.prepareHandoff("takeover")
+	if err != nil {
+		log.Println("[tablecloth] error preparing takeover, aborting:", err)
+		writeControlResponse(conn, &controlResponse{Error: err.Error()}, nil)
+		return
+	}
+	fds := make([]int, 0, len(h.Listeners))
+	for _, lr := range h.Listeners {
+		fds = append(fds, lr.Fd)
+	}
+	err = writeControlResponse(conn, &controlResponse{OK: true, Handoff: h}, fds)
+	// The receiving process has its own copies now.
+	h.closeFds()
+	if err != nil {
+		log.Println("[tablecloth] error sending listeners for takeover, aborting:", err)
+		return
+	}
+
+	err = m.awaitSuccessor(conn, dec)
+	if err != nil {
+		log.Println("[tablecloth] new process didn't become ready, aborting takeover:", err)
+		return
+	}
+
+	m.stopServers()
+}
+
+func writeControlResponse(conn *net.UnixConn, resp *controlResponse, fds []int) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	n, _, err := conn.WriteMsgUnix(data, oob, nil)
+	if err != nil {
+		return err
+	}
+	if n < len(data) {
+		_, err = conn.Write(data[n:])
+	}
+	return err
+}
+
+// takeoverClient is the connection used by a new process to take over the
+// listening sockets from the running one.
+type takeoverClient struct {
+	conn *net.UnixConn
+	dec  *json.Decoder
+}
+
+// takeover connects to the process serving on the given control socket, and
+// requests its listening sockets.  The file descriptors for these are
+// received over the socket using SCM_RIGHTS.
+func takeover(path string) (*handoff, *takeoverClient, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+	err = json.NewEncoder(conn).Encode(&controlRequest{Command: "takeover"})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(maxTakeoverFds*4))
+	n, oobn, flags, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	fds, err := parseRights(oob[:oobn])
+	if err == nil && flags&syscall.MSG_CTRUNC != 0 {
+		err = errors.New("too many file descriptors received")
+	}
+	if err != nil {
+		closeRawFds(fds)
+		conn.Close()
+		return nil, nil, err
+	}
+
+	c := &takeoverClient{
+		conn: conn,
+		dec:  json.NewDecoder(io.MultiReader(bytes.NewReader(buf[:n]), conn)),
+	}
+	var resp controlResponse
+	err = c.dec.Decode(&resp)
+	if err == nil && !resp.OK {
+		err = errors.New(resp.Error)
+	}
+	if err == nil && (resp.Handoff == nil || len(resp.Handoff.Listeners) != len(fds)) {
+		err = errors.New("mismatched listeners and file descriptors received")
+	}
+	if err != nil {
+		closeRawFds(fds)
+		conn.Close()
+		return nil, nil, err
+	}
+
+	h := resp.Handoff
+	for i := range h.Listeners {
+		h.Listeners[i].Fd = fds[i]
+	}
+	return h, c, nil
+}
+
+// ready reports to the previous process that this one is ready, and waits for
+// it to confirm that it has released the control socket.
+func (c *takeoverClient) ready() error {
+	defer c.conn.Close()
+
+	err := json.NewEncoder(c.conn).Encode(&controlRequest{Command: "ready"})
+	if err != nil {
+		return err
+	}
+	var resp controlResponse
+	err = c.dec.Decode(&resp)
+	if err != nil {
+		return err
+	}
+	if !resp.OK {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var fds []int
+	for _, msg := range msgs {
+		rights, err := syscall.ParseUnixRights(&msg)
+		if err != nil {
+			return fds, err
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+func closeRawFds(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
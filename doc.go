@@ -8,6 +8,10 @@ serving requests while the original process re-exec's itself.  Once this has hap
 child is stopped.  This means that after restart, the process retains the same process id, and
 therefore plays nicely with process supervisors like upstart.
 
+Alternatively, the listening sockets can be handed over to an independently started process (eg
+a new container, or a binary at a different path) using a control socket. See ControlSocket and
+Takeover for details.
+
 This implementation is based on an approach described here:
 http://blog.nella.org/zero-downtime-upgrades-of-tcp-servers-in-go/
 */
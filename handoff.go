@@ -0,0 +1,242 @@
+package tablecloth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// handoffVersion is the version of the handoff payload written by this
+// package. Readers ignore fields they don't know about, so this only needs
+// bumping when adding something that a reader must understand. In that case
+// handoffCompat should be bumped as well so that older readers fall back to
+// the legacy variables instead.
+const (
+	handoffVersion = 1
+	handoffCompat  = 1
+)
+
+const (
+	// handoffEnvVar holds the base64 encoded JSON handoff payload.
+	handoffEnvVar = "TABLECLOTH_HANDOFF"
+	// handoffFdEnvVar holds the number of an inherited file descriptor that
+	// the JSON handoff payload can be read from. This takes precedence over
+	// handoffEnvVar if both are set.
+	handoffFdEnvVar = "TABLECLOTH_HANDOFF_FD"
+
+	legacyListenFdPrefix    = "LISTEN_FD_"
+	legacyTemporaryChild    = "TEMPORARY_CHILD"
+	legacyTemporaryChildPid = "TEMPORARY_CHILD_PID"
+)
+
+// listenerRecord describes a listening socket passed to the next generation.
+type listenerRecord struct {
+	Ident   string `json:"ident"`
+	Fd      int    `json:"fd"`
+	Network string `json:"network"`
+	Address string `json:"address"`
+	TLS     bool   `json:"tls,omitempty"`
+}
+
+// handoff is the metadata passed from a process to the next generation when
+// restarting.
+type handoff struct {
+	// Version is the version of the writer, and Compat is the minimum
+	// version a reader must be to understand the payload.
+	Version int `json:"version"`
+	Compat  int `json:"compat"`
+
+	Generation        int              `json:"generation"`
+	ParentPid         int              `json:"parent_pid"`
+	Reason            string           `json:"reason,omitempty"`
+	TemporaryChild    bool             `json:"temporary_child,omitempty"`
+	TemporaryChildPid int              `json:"temporary_child_pid,omitempty"`
+	Listeners         []listenerRecord `json:"listeners"`
+
+	// ReadyFd is a unix socket connected to the previous generation, used to
+	// report that the new process is ready when handing over.
+	ReadyFd int `json:"ready_fd,omitempty"`
+}
+
+func newHandoff(generation int, reason string) *handoff {
+	return &handoff{
+		Version:    handoffVersion,
+		Compat:     handoffCompat,
+		Generation: generation,
+		ParentPid:  os.Getpid(),
+		Reason:     reason,
+	}
+}
+
+// readHandoff reads the handoff passed from the previous generation (if any).
+// It will always return a usable handoff, falling back to the legacy
+// variables if the payload is missing or can't be read.
+func readHandoff(em envMap) (*handoff, error) {
+	var (
+		data []byte
+		err  error
+	)
+	if fdStr, ok := em[handoffFdEnvVar]; ok {
+		data, err = readHandoffFd(fdStr)
+	} else if encoded, ok := em[handoffEnvVar]; ok {
+		data, err = base64.URLEncoding.DecodeString(encoded)
+	} else {
+		return legacyHandoff(em), nil
+	}
+	if err == nil {
+		var h *handoff
+		h, err = decodeHandoff(data)
+		if err == nil {
+			return h, nil
+		}
+	}
+	return legacyHandoff(em), fmt.Errorf("reading handoff payload: %s", err.Error())
+}
+
+func readHandoffFd(fdStr string) ([]byte, error) {
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "handoff")
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func decodeHandoff(data []byte) (*handoff, error) {
+	h := &handoff{}
+	err := json.Unmarshal(data, h)
+	if err != nil {
+		return nil, err
+	}
+	if h.Version < 1 {
+		return nil, errors.New("missing handoff version")
+	}
+	if h.Compat > handoffVersion {
+		return nil, fmt.Errorf("handoff payload requires version %d, have version %d", h.Compat, handoffVersion)
+	}
+	return h, nil
+}
+
+// legacyHandoff constructs a handoff from the variables used before the
+// versioned payload was introduced.
+func legacyHandoff(em envMap) *handoff {
+	h := &handoff{}
+	for k, v := range em {
+		if !strings.HasPrefix(k, legacyListenFdPrefix) {
+			continue
+		}
+		fd, err := strconv.Atoi(v)
+		if err != nil {
+			continue
+		}
+		h.Listeners = append(h.Listeners, listenerRecord{
+			Ident:   strings.TrimPrefix(k, legacyListenFdPrefix),
+			Fd:      fd,
+			Network: "tcp",
+		})
+	}
+	sort.Slice(h.Listeners, func(i, j int) bool { return h.Listeners[i].Ident < h.Listeners[j].Ident })
+	h.TemporaryChild = em[legacyTemporaryChild] == "1"
+	h.TemporaryChildPid, _ = strconv.Atoi(em[legacyTemporaryChildPid])
+	return h
+}
+
+// inherited returns whether anything was passed from a previous process.
+func (h *handoff) inherited() bool {
+	return h.ParentPid != 0 || h.TemporaryChild || h.TemporaryChildPid != 0 || len(h.Listeners) > 0
+}
+
+func (h *handoff) listener(ident string) *listenerRecord {
+	for i := range h.Listeners {
+		if h.Listeners[i].Ident == ident {
+			return &h.Listeners[i]
+		}
+	}
+	return nil
+}
+
+func (h *handoff) listenerFd(ident string) int {
+	if lr := h.listener(ident); lr != nil {
+		return lr.Fd
+	}
+	return 0
+}
+
+// closeFds closes all the file descriptors referenced by the handoff.  This is
+// used to clean up when starting a new process fails so we don't leak.
+func (h *handoff) closeFds() {
+	for _, lr := range h.Listeners {
+		os.NewFile(uintptr(lr.Fd), lr.Ident).Close()
+	}
+	if h.ReadyFd != 0 {
+		os.NewFile(uintptr(h.ReadyFd), "ready socket").Close()
+	}
+}
+
+// apply adds the handoff to the given environment, replacing any handoff
+// details already present.
+//
+// The legacy variables are also set so that an older version of the
+// application is still able to pick up the listeners.  This is skipped for
+// any idents that aren't valid in an environment variable name.
+func (h *handoff) apply(em envMap) error {
+	clearHandoff(em)
+
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	em[handoffEnvVar] = base64.URLEncoding.EncodeToString(data)
+
+	for _, lr := range h.Listeners {
+		if validEnvName(lr.Ident) {
+			em[legacyListenFdPrefix+lr.Ident] = strconv.Itoa(lr.Fd)
+		}
+	}
+	if h.TemporaryChild {
+		em[legacyTemporaryChild] = "1"
+	}
+	if h.TemporaryChildPid != 0 {
+		em[legacyTemporaryChildPid] = strconv.Itoa(h.TemporaryChildPid)
+	}
+	return nil
+}
+
+// clearHandoff removes all handoff details from the given environment.
+func clearHandoff(em envMap) {
+	for k := range em {
+		if isHandoffVar(k) {
+			delete(em, k)
+		}
+	}
+}
+
+func isHandoffVar(name string) bool {
+	switch name {
+	case handoffEnvVar, handoffFdEnvVar, legacyTemporaryChild, legacyTemporaryChildPid:
+		return true
+	}
+	return strings.HasPrefix(name, legacyListenFdPrefix)
+}
+
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package tablecloth
+
+import (
+	"encoding/base64"
+	"os"
+	"strconv"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Handoff", func() {
+	var h *handoff
+
+	BeforeEach(func() {
+		h = newHandoff(3, "SIGHUP")
+		h.Listeners = []listenerRecord{
+			{Ident: "main", Fd: 5, Network: "tcp", Address: "127.0.0.1:8080"},
+			{Ident: "admin.v2", Fd: 6, Network: "tcp", Address: "127.0.0.1:8081"},
+		}
+	})
+
+	It("should round-trip through the environment", func() {
+		em := envMap{"FOO": "bar"}
+		Expect(h.apply(em)).To(Succeed())
+
+		read, err := readHandoff(em)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read).To(Equal(h))
+		Expect(read.listenerFd("admin.v2")).To(Equal(6))
+		Expect(read.listenerFd("missing")).To(Equal(0))
+	})
+
+	It("should set the legacy variables for idents that are valid variable names", func() {
+		h.TemporaryChild = true
+		h.TemporaryChildPid = 1234
+		em := envMap{}
+		Expect(h.apply(em)).To(Succeed())
+
+		Expect(em).To(HaveKeyWithValue("LISTEN_FD_main", "5"))
+		Expect(em).NotTo(HaveKey("LISTEN_FD_admin.v2"))
+		Expect(em).To(HaveKeyWithValue("TEMPORARY_CHILD", "1"))
+		Expect(em).To(HaveKeyWithValue("TEMPORARY_CHILD_PID", "1234"))
+	})
+
+	It("should replace any existing handoff details", func() {
+		em := envMap{"LISTEN_FD_old": "9", "TEMPORARY_CHILD_PID": "42"}
+		Expect(h.apply(em)).To(Succeed())
+
+		Expect(em).NotTo(HaveKey("LISTEN_FD_old"))
+		Expect(em).NotTo(HaveKey("TEMPORARY_CHILD_PID"))
+	})
+
+	It("should read the payload from a file descriptor", func() {
+		em := envMap{}
+		Expect(h.apply(em)).To(Succeed())
+		data, err := base64.URLEncoding.DecodeString(em[handoffEnvVar])
+		Expect(err).NotTo(HaveOccurred())
+
+		r, w, err := os.Pipe()
+		Expect(err).NotTo(HaveOccurred())
+		_, err = w.Write(data)
+		Expect(err).NotTo(HaveOccurred())
+		w.Close()
+
+		read, err := readHandoff(envMap{handoffFdEnvVar: strconv.Itoa(int(r.Fd()))})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read).To(Equal(h))
+	})
+
+	It("should fall back to the legacy variables if the payload requires a newer version", func() {
+		h.Compat = handoffVersion + 1
+		em := envMap{}
+		Expect(h.apply(em)).To(Succeed())
+
+		read, err := readHandoff(em)
+		Expect(err).To(HaveOccurred())
+		Expect(read.Generation).To(Equal(0))
+		Expect(read.listenerFd("main")).To(Equal(5))
+	})
+
+	It("should read the legacy variables when there's no payload", func() {
+		read, err := readHandoff(envMap{
+			"LISTEN_FD_one":       "3",
+			"LISTEN_FD_two":       "4",
+			"TEMPORARY_CHILD":     "1",
+			"TEMPORARY_CHILD_PID": "99",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(read.listenerFd("one")).To(Equal(3))
+		Expect(read.listenerFd("two")).To(Equal(4))
+		Expect(read.TemporaryChild).To(BeTrue())
+		Expect(read.TemporaryChildPid).To(Equal(99))
+	})
+})
@@ -0,0 +1,167 @@
+package tablecloth
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// RestartMode determines how the application is restarted when it receives a
+// SIGHUP.
+type RestartMode int
+
+const (
+	// RestartReExec starts a temporary child process to serve requests while
+	// the original process re-exec's itself.  The process therefore retains
+	// the same pid after restarting.  This is the default.
+	RestartReExec RestartMode = iota
+
+	// RestartHandover starts the new generation as a child process, and once
+	// it's ready the original process stops its servers so that the
+	// ListenAndServe calls return.  The pid therefore changes on restart, and
+	// PidFile is updated and systemd is notified of the new main pid.  This
+	// avoids starting the application twice on each restart.
+	RestartHandover
+)
+
+// The mode used to restart the application.
+var Mode = RestartReExec
+
+// handOver starts the new generation as a child process, and waits for it to
+// become ready.
+func (m *manager) handOver(h *handoff) error {
+	conn, fd, err := successorSocket()
+	if err != nil {
+		h.closeFds()
+		return err
+	}
+	defer conn.Close()
+	h.ReadyFd = fd
+
+	proc, err := m.startChild(h)
+	// The child has its own copies of these now.
+	h.closeFds()
+	if err != nil {
+		return err
+	}
+
+	err = m.awaitSuccessor(conn, json.NewDecoder(conn))
+	if err != nil {
+		proc.Kill()
+		proc.Wait()
+		return err
+	}
+	proc.Release()
+
+	if PidFile != "" {
+		err = writePidFile(PidFile, proc.Pid)
+		if err != nil {
+			log.Println("[tablecloth] error updating pid file:", err)
+		}
+	}
+	err = sdNotify("MAINPID=" + strconv.Itoa(proc.Pid))
+	if err != nil {
+		log.Println("[tablecloth] error notifying systemd of new main pid:", err)
+	}
+	return nil
+}
+
+// successorSocket creates a connected pair of unix sockets used to wait for
+// the next generation to become ready.  It returns a connection for one end,
+// and an inheritable file descriptor for the other end to be passed to the
+// new process.
+func successorSocket() (*net.UnixConn, int, error) {
+	// Hold the ForkLock so that no other process is started while the
+	// parent's end doesn't yet have the CloseOnExec flag set.
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	conn, err := fileUnixConn(fds[0])
+	if err != nil {
+		syscall.Close(fds[1])
+		return nil, 0, err
+	}
+	return conn, fds[1], nil
+}
+
+// successorClient returns the connection used to report readiness to the
+// previous generation.
+func successorClient(fd int) (*takeoverClient, error) {
+	conn, err := fileUnixConn(fd)
+	if err != nil {
+		return nil, err
+	}
+	return &takeoverClient{conn: conn, dec: json.NewDecoder(conn)}, nil
+}
+
+// fileUnixConn returns a UnixConn for the given file descriptor, closing the
+// original descriptor.
+func fileUnixConn(fd int) (*net.UnixConn, error) {
+	f := os.NewFile(uintptr(fd), "unix socket")
+	c, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := c.(*net.UnixConn)
+	if !ok {
+		c.Close()
+		return nil, errors.New("passed file descriptor is not for a unix socket")
+	}
+	return conn, nil
+}
+
+// awaitSuccessor waits for the new process on the other end of conn to report
+// that it's ready, and then releases the control socket to it.
+func (m *manager) awaitSuccessor(conn *net.UnixConn, dec *json.Decoder) error {
+	conn.SetReadDeadline(time.Now().Add(ReadyTimeout))
+	var req controlRequest
+	err := dec.Decode(&req)
+	if err == io.EOF {
+		return errors.New("new process exited before becoming ready")
+	}
+	if err != nil {
+		return err
+	}
+	if req.Command != "ready" {
+		return errors.New("unexpected command: " + req.Command)
+	}
+
+	// Stop listening on the control socket before confirming so that the new
+	// process can take it over.
+	m.closeControl()
+	return writeControlResponse(conn, &controlResponse{OK: true}, nil)
+}
+
+// sdNotify sends the given state to systemd's notification socket if the
+// process is being run by systemd.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// Abstract namespace socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
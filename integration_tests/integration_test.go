@@ -205,6 +205,152 @@ var _ = Describe("Tablecloth HTTP listener", func() {
 		Expect(string(newBody)).To(ContainSubstring("Hello (pid=%d)", parentPid))
 	})
 
+	Describe("taking over from a running process", func() {
+		var (
+			tempDir       string
+			controlSocket string
+		)
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = ioutil.TempDir("", "tablecloth")
+			Expect(err).NotTo(HaveOccurred())
+			controlSocket = tempDir + "/control.sock"
+
+			serverCmd, serverAddr = startServer("simple/server", "-controlSocket="+controlSocket)
+		})
+		AfterEach(func() {
+			os.RemoveAll(tempDir)
+		})
+
+		It("should hand over the listeners to the new process", func() {
+			oldCmd := serverCmd
+			resp, err := http.Get("http://" + serverAddr + "/")
+			Expect(err).NotTo(HaveOccurred())
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(string(body)).To(ContainSubstring("Hello (pid=%d)", oldCmd.Process.Pid))
+
+			serverCmd = execServer("simple/server", "-controlSocket="+controlSocket, "-takeover", "-listenAddr="+serverAddr)
+
+			Eventually(processExited(oldCmd), 2*time.Second).Should(BeClosed())
+
+			resp, err = http.Get("http://" + serverAddr + "/")
+			Expect(err).NotTo(HaveOccurred())
+			body, _ = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(string(body)).To(ContainSubstring("Hello (pid=%d)", serverCmd.Process.Pid))
+		})
+
+		It("should not drop any requests while handing over", func() {
+			oldCmd := serverCmd
+			resultCh := startVegetaAttack([]string{"GET http://" + serverAddr}, 40, 2*time.Second)
+
+			time.Sleep(100 * time.Millisecond)
+			serverCmd = execServer("simple/server", "-controlSocket="+controlSocket, "-takeover", "-listenAddr="+serverAddr)
+
+			metrics := <-resultCh
+			Expect(metrics.StatusCodes["200"]).To(Equal(int(metrics.Requests)))
+			Eventually(processExited(oldCmd), 2*time.Second).Should(BeClosed())
+		})
+
+		It("should allow the new process to be taken over in turn", func() {
+			oldCmd := serverCmd
+			serverCmd = execServer("simple/server", "-controlSocket="+controlSocket, "-takeover", "-listenAddr="+serverAddr)
+			Eventually(processExited(oldCmd), 2*time.Second).Should(BeClosed())
+
+			oldCmd = serverCmd
+			serverCmd = execServer("simple/server", "-controlSocket="+controlSocket, "-takeover", "-listenAddr="+serverAddr)
+			Eventually(processExited(oldCmd), 2*time.Second).Should(BeClosed())
+
+			resp, err := http.Get("http://" + serverAddr + "/")
+			Expect(err).NotTo(HaveOccurred())
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(string(body)).To(ContainSubstring("Hello (pid=%d)", serverCmd.Process.Pid))
+		})
+	})
+
+	Describe("restarting in handover mode", func() {
+		var (
+			tempDir string
+			pidFile string
+		)
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = ioutil.TempDir("", "tablecloth")
+			Expect(err).NotTo(HaveOccurred())
+			pidFile = tempDir + "/server.pid"
+		})
+		AfterEach(func() {
+			if pid := readPidFile(pidFile); pid != 0 {
+				syscall.Kill(pid, syscall.SIGINT)
+			}
+			os.RemoveAll(tempDir)
+		})
+
+		It("should hand over to a new process and exit", func() {
+			serverCmd, serverAddr = startServer("simple/server", "-mode=handover", "-pidFile="+pidFile)
+			oldPid := serverCmd.Process.Pid
+			Eventually(func() int { return readPidFile(pidFile) }).Should(Equal(oldPid))
+
+			reloadServer(serverCmd)
+			Eventually(processExited(serverCmd), 2*time.Second).Should(BeClosed())
+
+			newPid := readPidFile(pidFile)
+			Expect(newPid).NotTo(Equal(oldPid))
+
+			resp, err := http.Get("http://" + serverAddr + "/")
+			Expect(err).NotTo(HaveOccurred())
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			Expect(string(body)).To(ContainSubstring("Hello (pid=%d)", newPid))
+		})
+
+		It("should not drop any requests while handing over", func() {
+			serverCmd, serverAddr = startServer("simple/server", "-mode=handover", "-pidFile="+pidFile)
+			resultCh := startVegetaAttack([]string{"GET http://" + serverAddr}, 40, 2*time.Second)
+
+			time.Sleep(100 * time.Millisecond)
+			serverCmd.Process.Signal(syscall.SIGHUP)
+
+			metrics := <-resultCh
+			Expect(metrics.StatusCodes["200"]).To(Equal(int(metrics.Requests)))
+			Eventually(processExited(serverCmd), 2*time.Second).Should(BeClosed())
+		})
+
+		Context("the new server exits shortly after starting", func() {
+			var cwd string
+			BeforeEach(func() {
+				cwd, _ = os.Getwd()
+				Expect(os.Symlink(cwd+"/test_servers/v1", cwd+"/test_servers/current")).To(Succeed())
+				Expect(os.Chdir(cwd + "/test_servers/current")).To(Succeed())
+				serverCmd, serverAddr = startServer("./server", "-mode=handover", "-pidFile="+pidFile, "-workingDir="+cwd+"/test_servers/current")
+			})
+			AfterEach(func() {
+				os.Chdir(cwd)
+				os.Remove(cwd + "/test_servers/current")
+			})
+
+			It("should continue running the old server", func() {
+				Expect(os.Remove(cwd + "/test_servers/current")).To(Succeed())
+				Expect(os.Symlink(cwd+"/test_servers/errorer", cwd+"/test_servers/current")).To(Succeed())
+
+				withSilentOutput(func() {
+					reloadServer(serverCmd)
+				})
+
+				Expect(readPidFile(pidFile)).To(Equal(serverCmd.Process.Pid))
+				resp, err := http.Get("http://" + serverAddr + "/")
+				Expect(err).NotTo(HaveOccurred())
+				body, _ := ioutil.ReadAll(resp.Body)
+				resp.Body.Close()
+				Expect(string(body)).To(ContainSubstring("Hello from v1 (pid=%d)", serverCmd.Process.Pid))
+			})
+		})
+	})
+
 	Describe("changing the working directory", func() {
 		var (
 			cwd string
@@ -506,6 +652,28 @@ func stopServer(cmd *exec.Cmd) {
 	}
 }
 
+// processExited returns a channel that's closed once the given process has
+// exited.
+func processExited(cmd *exec.Cmd) chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		// Not using cmd.Wait() because that would also wait for any child
+		// processes that have inherited stdout/stderr.
+		cmd.Process.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+func readPidFile(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return pid
+}
+
 func canReadProcessFds() bool {
 	fi, err := os.Stat(fmt.Sprintf("/proc/%d/fd", os.Getpid()))
 	if err != nil {
@@ -18,6 +18,10 @@ var (
 	listenAddr      = flag.String("listenAddr", ":8081", "The address to listen on")
 	closeTimeoutStr = flag.String("closeTimeout", "500ms", "How long to wait for connections to gracefully close")
 	workingDir      = flag.String("workingDir", "", "The directory to change to before re-execing")
+	controlSocket   = flag.String("controlSocket", "", "The path of the control socket to listen on")
+	takeover        = flag.Bool("takeover", false, "Take over the listeners from the process serving on controlSocket")
+	mode            = flag.String("mode", "reexec", "The restart mode to use (reexec or handover)")
+	pidFile         = flag.String("pidFile", "", "The path of the pid file to write")
 )
 
 func main() {
@@ -36,6 +40,19 @@ func main() {
 		tablecloth.WorkingDir = *workingDir
 	}
 
+	tablecloth.ControlSocket = *controlSocket
+	tablecloth.Takeover = *takeover
+	tablecloth.PidFile = *pidFile
+
+	switch *mode {
+	case "reexec":
+		tablecloth.Mode = tablecloth.RestartReExec
+	case "handover":
+		tablecloth.Mode = tablecloth.RestartHandover
+	default:
+		log.Fatal("Invalid mode: ", *mode)
+	}
+
 	err = tablecloth.ListenAndServe(*listenAddr, http.HandlerFunc(serverResponse))
 	if err != nil {
 		log.Fatal("Serve error: ", err)
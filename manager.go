@@ -10,7 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"os/signal"
-	"strconv"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
@@ -19,6 +19,17 @@ import (
 // How long to wait for a newly started process to start serving requests.
 var StartupDelay = 5 * time.Second
 
+// Optional: when set, a newly started process is only considered ready once the
+// application calls Ready.  Otherwise it's considered ready StartupDelay after
+// it started.
+//
+// This applies when handing over to a new process (see Mode and Takeover).
+var ExplicitReady bool
+
+// How long to wait for a newly started process to report that it's ready
+// when handing over to it.
+var ReadyTimeout = 30 * time.Second
+
 // The maximum time to wait for outstanding connections to complete after
 // closing the servers.
 var CloseWaitTimeout = 30 * time.Second
@@ -108,6 +119,14 @@ func ListenAndServe(addr string, handler http.Handler, identifier ...string) err
 	return theManager.listenAndServe(addr, handler, ident)
 }
 
+// Ready reports that the application has finished starting up, and is ready to
+// take over from the previous process.  This only has an effect when
+// ExplicitReady is set.
+func Ready() {
+	theManager.once.Do(setupFunc)
+	theManager.markReady()
+}
+
 type serverInfo struct {
 	listener *net.TCPListener
 	server   *http.Server
@@ -120,17 +139,95 @@ type manager struct {
 	serversLock   sync.Mutex
 	activeServers sync.WaitGroup
 	inParent      bool
+	inherited     *handoff
+	generation    int
+	reExecPending bool
+	ready         chan struct{}
+	readyOnce     sync.Once
+	controlLock   sync.Mutex
+	control       *net.UnixListener
 }
 
 func (m *manager) setup() {
 	m.servers = make(map[string]*serverInfo)
-	m.inParent = os.Getenv("TEMPORARY_CHILD") != "1"
+	m.ready = make(chan struct{})
+	if !ExplicitReady {
+		go func() {
+			time.Sleep(StartupDelay)
+			m.markReady()
+		}()
+	}
+
+	em := newEnvMap(os.Environ())
+	h, err := readHandoff(em)
+	if err != nil {
+		log.Println("[tablecloth] error reading handoff, falling back to legacy variables:", err)
+	}
+	// Remove the handoff from the environment so that it isn't inherited by
+	// any processes started by the application.
+	for k := range em {
+		if isHandoffVar(k) {
+			os.Unsetenv(k)
+		}
+	}
+
+	var tc *takeoverClient
+	if h.ReadyFd != 0 {
+		tc, err = successorClient(h.ReadyFd)
+		if err != nil {
+			log.Println("[tablecloth] error connecting to previous process:", err)
+		}
+		h.ReadyFd = 0
+	} else if Takeover && ControlSocket != "" && !h.inherited() {
+		var th *handoff
+		th, tc, err = takeover(ControlSocket)
+		if err != nil {
+			log.Println("[tablecloth] unable to take over from running process, listening afresh:", err)
+		} else {
+			h = th
+		}
+	}
+
+	m.inherited = h
+	m.generation = h.Generation
+	m.inParent = !h.TemporaryChild
 
 	go m.handleSignals()
 
-	if m.inParent {
+	if tc != nil {
+		go m.completeTakeover(tc)
+	} else if m.inParent {
 		go m.stopTemporaryChild()
+		go m.becomePrimary()
+	}
+}
+
+func (m *manager) markReady() {
+	m.readyOnce.Do(func() { close(m.ready) })
+}
+
+// completeTakeover waits for this process to become ready, and then tells the
+// previous process to stop.
+func (m *manager) completeTakeover(tc *takeoverClient) {
+	<-m.ready
+
+	err := tc.ready()
+	if err != nil {
+		log.Println("[tablecloth] error completing takeover:", err)
 	}
+	m.becomePrimary()
+}
+
+// becomePrimary is called once this process has taken over from any previous
+// process as the one responsible for the application.
+func (m *manager) becomePrimary() {
+	if PidFile != "" {
+		err := writePidFile(PidFile, os.Getpid())
+		if err != nil {
+			log.Println("[tablecloth] error writing pid file:", err)
+		}
+	}
+	m.serveControl()
 }
 
 func (m *manager) listenAndServe(addr string, handler http.Handler, ident string) error {
@@ -146,7 +243,7 @@ func (m *manager) listenAndServe(addr string, handler http.Handler, ident string
 	err = si.server.Serve(si.listener)
 	if err == http.ErrServerClosed {
 		si.wg.Wait() // Done() called in stopServers()
-		if m.inParent {
+		if m.reExecPending {
 			// This function will now never return, so the above defer won't happen.
 			m.activeServers.Done()
 
@@ -169,7 +266,7 @@ func (m *manager) setupServer(addr, ident string, handler http.Handler) (*server
 		return nil, errors.New("duplicate ident")
 	}
 
-	l, err := resumeOrListen(listenFdFromEnv(ident), addr)
+	l, err := resumeOrListen(m.inherited.listenerFd(ident), addr)
 	if err != nil {
 		return nil, err
 	}
@@ -181,29 +278,21 @@ func (m *manager) setupServer(addr, ident string, handler http.Handler) (*server
 	return si, nil
 }
 
-func listenFdFromEnv(ident string) int {
-	listenFD, err := strconv.Atoi(os.Getenv("LISTEN_FD_" + ident))
-	if err != nil {
-		return 0
-	}
-	return listenFD
-}
-
 func (m *manager) handleSignals() {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGHUP)
 
 	for _ = range c {
-		m.handleHUP()
+		m.handleHUP("SIGHUP")
 	}
 }
 
-func (m *manager) handleHUP() {
+func (m *manager) handleHUP(reason string) {
 	m.serversLock.Lock()
 	defer m.serversLock.Unlock()
 
 	if m.inParent {
-		err := m.upgradeServer()
+		err := m.upgradeServer(reason)
 		if err != nil {
 			log.Println("[tablecloth] error starting new server, aborting reload:", err)
 			return
@@ -213,22 +302,19 @@ func (m *manager) handleHUP() {
 	m.stopServers()
 }
 
-func (m *manager) upgradeServer() error {
-	fds := make(map[string]int, len(m.servers))
-	for ident, si := range m.servers {
-		fd, err := prepareListenerFd(si.listener)
-		if err != nil {
-			// Close any that were successfully prepared so we don't leak.
-			closeFds(fds)
-			return err
-		}
-		fds[ident] = fd
+func (m *manager) upgradeServer(reason string) error {
+	h, err := m.prepareHandoff(reason)
+	if err != nil {
+		return err
+	}
+	if Mode == RestartHandover {
+		return m.handOver(h)
 	}
 
-	proc, err := m.startTemporaryChild(fds)
+	proc, err := m.startTemporaryChild(h)
 	if err != nil {
 		// Close all the copied file descriptors so we don't leak.
-		closeFds(fds)
+		h.closeFds()
 		return err
 	}
 
@@ -236,18 +322,43 @@ func (m *manager) upgradeServer() error {
 
 	err = assertChildStillRunning(proc.Pid)
 	if err != nil {
-		closeFds(fds)
+		h.closeFds()
+		proc.Release()
 		return err
 	}
 
-	go m.reExecSelf(fds, proc.Pid)
+	m.reExecPending = true
+	go m.reExecSelf(h, proc.Pid)
 	return nil
 }
 
-func closeFds(fds map[string]int) {
-	for ident, fd := range fds {
-		os.NewFile(uintptr(fd), ident).Close()
+// prepareHandoff builds the handoff for the next generation, preparing a copy
+// of each listener's file descriptor to be passed on.
+func (m *manager) prepareHandoff(reason string) (*handoff, error) {
+	idents := make([]string, 0, len(m.servers))
+	for ident := range m.servers {
+		idents = append(idents, ident)
+	}
+	sort.Strings(idents)
+
+	h := newHandoff(m.generation+1, reason)
+	for _, ident := range idents {
+		si := m.servers[ident]
+		fd, err := prepareListenerFd(si.listener)
+		if err != nil {
+			// Close any that were successfully prepared so we don't leak.
+			h.closeFds()
+			return nil, err
+		}
+		h.Listeners = append(h.Listeners, listenerRecord{
+			Ident:   ident,
+			Fd:      fd,
+			Network: "tcp",
+			Address: si.listener.Addr().String(),
+			TLS:     si.server.TLSConfig != nil,
+		})
 	}
+	return h, nil
 }
 
 func assertChildStillRunning(pid int) error {
@@ -262,9 +373,12 @@ func assertChildStillRunning(pid int) error {
 }
 
 func (m *manager) stopServers() {
-	ctx, _ := context.WithTimeout(context.Background(), CloseWaitTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), CloseWaitTimeout)
+	var wg sync.WaitGroup
 	for _, si := range m.servers {
+		wg.Add(1)
 		go func(si *serverInfo) {
+			defer wg.Done()
 			defer si.wg.Done()
 			err := si.server.Shutdown(ctx)
 			if err != nil {
@@ -272,17 +386,22 @@ func (m *manager) stopServers() {
 			}
 		}(si)
 	}
+	go func() {
+		wg.Wait()
+		cancel()
+	}()
 }
 
-func (m *manager) reExecSelf(fds map[string]int, childPid int) {
+func (m *manager) reExecSelf(h *handoff, childPid int) {
 	// wait until there are no active servers
 	m.activeServers.Wait()
 
+	h.TemporaryChildPid = childPid
 	em := newEnvMap(os.Environ())
-	for ident, fd := range fds {
-		em["LISTEN_FD_"+ident] = strconv.Itoa(fd)
+	err := h.apply(em)
+	if err != nil {
+		log.Println("[tablecloth] error preparing handoff for re-exec:", err)
 	}
-	em["TEMPORARY_CHILD_PID"] = strconv.Itoa(childPid)
 
 	if WorkingDir != "" {
 		os.Chdir(WorkingDir)
@@ -290,17 +409,22 @@ func (m *manager) reExecSelf(fds map[string]int, childPid int) {
 	syscall.Exec(os.Args[0], os.Args, em.ToEnv())
 }
 
-func (m *manager) startTemporaryChild(fds map[string]int) (proc *os.Process, err error) {
+func (m *manager) startTemporaryChild(h *handoff) (proc *os.Process, err error) {
+	childHandoff := *h
+	childHandoff.TemporaryChild = true
+	return m.startChild(&childHandoff)
+}
 
+func (m *manager) startChild(h *handoff) (proc *os.Process, err error) {
 	cmd := exec.Command(os.Args[0], os.Args[1:]...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
 	em := newEnvMap(os.Environ())
-	for ident, fd := range fds {
-		em["LISTEN_FD_"+ident] = strconv.Itoa(fd)
+	err = h.apply(em)
+	if err != nil {
+		return nil, err
 	}
-	em["TEMPORARY_CHILD"] = "1"
 	cmd.Env = em.ToEnv()
 	if WorkingDir != "" {
 		cmd.Dir = WorkingDir
@@ -314,9 +438,9 @@ func (m *manager) startTemporaryChild(fds map[string]int) (proc *os.Process, err
 }
 
 func (m *manager) stopTemporaryChild() {
-	childPid, err := strconv.Atoi(os.Getenv("TEMPORARY_CHILD_PID"))
-	if err != nil {
-		// non-integer/blank TEMPORARY_CHILD_PID so ignore
+	childPid := m.inherited.TemporaryChildPid
+	if childPid == 0 {
+		// Not started by re-exec so there's no temporary child to stop
 		return
 	}
 
@@ -25,6 +25,7 @@ var _ = Describe("Adding servers", func() {
 		setupCount = 0
 		setupFunc = func() {
 			theManager.servers = make(map[string]*serverInfo)
+			theManager.inherited = &handoff{}
 			setupCount++
 		}
 	})